@@ -0,0 +1,713 @@
+// Copyright 2020 Acnodal Inc.
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	purelbv1 "purelb.io/pkg/apis/v1"
+)
+
+// Family is an IP address family, either IPv4 or IPv6.
+type Family int
+
+const (
+	FamilyV4 Family = iota
+	FamilyV6
+)
+
+// String returns a human-readable name for f.
+func (f Family) String() string {
+	if f == FamilyV6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// FamilyOf returns the Family that ip belongs to.
+func FamilyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyV4
+	}
+	return FamilyV6
+}
+
+// Port represents one port in use by a service.
+type Port struct {
+	Proto string
+	Port  int
+}
+
+// Ports returns the list of ports that svc listens on.
+func Ports(svc *v1.Service) []Port {
+	var ret []Port
+	for _, p := range svc.Spec.Ports {
+		ret = append(ret, Port{Proto: string(p.Protocol), Port: int(p.Port)})
+	}
+	return ret
+}
+
+// SharingKey returns the sharing key that svc requests, or "" if
+// svc doesn't want to share its address with any other Service.
+func SharingKey(svc *v1.Service) string {
+	return svc.Annotations[purelbv1.SharingAnnotation]
+}
+
+// pool is one address pool, plus the bookkeeping needed to hand out
+// addresses from it and to track what's already allocated.
+type pool struct {
+	name   string
+	cidr   *net.IPNet
+	family Family
+
+	// inUse tracks every key (or, for a reserved-but-unclaimed
+	// address, the reservationOwnerPrefix placeholder) currently
+	// holding each address, so we can skip full slots when allocating
+	// and tell whether an address asked for by name or by IP is free.
+	// More than one real key can hold the same slot if they all agree
+	// on a sharing key and don't have conflicting ports; see assign.
+	inUse map[string][]string // ip.String() -> owning keys
+
+	// clusterset marks a pool whose allocations are coordinated
+	// across clusters through the Allocator's ClustersetBroker,
+	// rather than decided purely from this cluster's own inUse map.
+	clusterset bool
+}
+
+func (p *pool) contains(ip net.IP) bool {
+	return p.cidr.Contains(ip)
+}
+
+// first returns the first address in p's CIDR that isn't already in
+// use, or nil if the pool is full.
+func (p *pool) first() net.IP {
+	ip := p.cidr.IP.Mask(p.cidr.Mask)
+	for p.cidr.Contains(ip) {
+		if len(p.inUse[ip.String()]) == 0 {
+			return append(net.IP(nil), ip...)
+		}
+		ip = nextIP(ip)
+	}
+	return nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// allocation records what a single key (a Service's
+// namespace/name) has allocated from one pool.
+type allocation struct {
+	pool       string
+	ip         net.IP
+	ports      []Port
+	sharingKey string
+
+	// clustersetAllocatedBy is the ID of the cluster that first
+	// allocated this address through a ClustersetBroker, or "" if the
+	// address came from an ordinary, uncoordinated pool.
+	clustersetAllocatedBy string
+}
+
+// reservationOwnerPrefix marks a pool slot as held by a named
+// Address reservation (as opposed to an actual Service key) in a
+// pool's inUse map, so SetReservations can tell the two apart.
+const reservationOwnerPrefix = "reservation:"
+
+// reservation is a named, pre-reserved address carved out of a
+// pool. Unlike a regular allocation it exists whether or not any
+// Service is currently using it.
+type reservation struct {
+	name       string
+	pool       string
+	ip         net.IP
+	sharingKey string
+
+	// boundTo holds the keys of the Services currently bound to this
+	// reservation, empty if unclaimed. More than one key only ever
+	// appears here if sharingKey is set and every bound key requested
+	// it via its own sharing key, the same way pool addresses are
+	// shared; see AssignNamed.
+	boundTo []string
+}
+
+// Allocator tracks the state of the configured address pools,
+// mapping addresses to the keys (Services) that own them.
+type Allocator struct {
+	pools map[string]*pool
+
+	// allocated maps a key to its current allocations, at most one
+	// per address family.
+	allocated map[string]map[Family]*allocation
+
+	// reservations holds the named Address objects that have
+	// carved addresses out of the pools above.
+	reservations map[string]*reservation
+
+	// clusterID and broker are set by SetClusterset and consulted by
+	// AllocateFromPool whenever the target pool is Clusterset-
+	// enabled. broker is nil until SetClusterset is called, which is
+	// fine as long as no pool is Clusterset-enabled.
+	clusterID string
+	broker    ClustersetBroker
+}
+
+// New returns an Allocator, ready to use.
+func New() *Allocator {
+	return &Allocator{
+		pools:        map[string]*pool{},
+		allocated:    map[string]map[Family]*allocation{},
+		reservations: map[string]*reservation{},
+	}
+}
+
+// SetClusterset configures the ClustersetBroker used to coordinate
+// allocation for Clusterset-enabled pools, and the ID this cluster
+// identifies itself with when talking to it.
+func (a *Allocator) SetClusterset(clusterID string, broker ClustersetBroker) {
+	a.clusterID = clusterID
+	a.broker = broker
+}
+
+// SetPools updates the set of address pools that the allocator can
+// allocate from. Any key that's currently allocated from a pool that
+// no longer exists keeps its address (we never yank addresses out
+// from under a running Service), but new allocations will only come
+// from the pools passed in here.
+func (a *Allocator) SetPools(groups []*purelbv1.ServiceGroup) error {
+	pools := map[string]*pool{}
+
+	for _, group := range groups {
+		local := group.Spec.Local
+		if local == nil || local.Pool == "" {
+			continue
+		}
+
+		p, err := newPool(group.Name, local.Pool)
+		if err != nil {
+			return fmt.Errorf("parsing pool %q: %s", group.Name, err)
+		}
+		p.clusterset = group.Spec.Clusterset != nil
+		pools[p.name] = p
+
+		if local.Pool6 != "" {
+			p6, err := newPool(poolName(group.Name, FamilyV6), local.Pool6)
+			if err != nil {
+				return fmt.Errorf("parsing pool %q: %s", group.Name, err)
+			}
+			if p6.family != FamilyV6 {
+				return fmt.Errorf("pool %q: pool6 %q is not an IPv6 CIDR", group.Name, local.Pool6)
+			}
+			p6.clusterset = p.clusterset
+			pools[p6.name] = p6
+		}
+	}
+
+	// carry forward in-use accounting for pools that still exist, so
+	// reconfiguring doesn't forget who owns what.
+	for name, old := range a.pools {
+		if p, ok := pools[name]; ok {
+			p.inUse = old.inUse
+		}
+	}
+
+	a.pools = pools
+	return nil
+}
+
+// SetReservations updates the set of named Address reservations.
+// Reserved addresses are marked in-use in their pool as soon as
+// they're configured, so a config reload can never hand one out to
+// a Service that doesn't ask for it by name, even if nothing has
+// claimed it yet.
+func (a *Allocator) SetReservations(addrs []*purelbv1.Address) error {
+	reservations := map[string]*reservation{}
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr.Spec.Address)
+		if ip == nil {
+			return fmt.Errorf("address %q: invalid address %q", addr.Name, addr.Spec.Address)
+		}
+		p, ok := a.pools[addr.Spec.Pool]
+		if !ok {
+			return fmt.Errorf("address %q: unknown pool %q", addr.Name, addr.Spec.Pool)
+		}
+		if !p.contains(ip) {
+			// An IPv6 address of a dual-stack group falls in its Pool6
+			// half, which is tracked under poolName(group, FamilyV6).
+			p6, ok := a.pools[poolName(addr.Spec.Pool, FamilyV6)]
+			if !ok || !p6.contains(ip) {
+				return fmt.Errorf("address %q: %q is not within pool %q", addr.Name, ip, addr.Spec.Pool)
+			}
+			p = p6
+		}
+
+		r := &reservation{name: addr.Name, pool: p.name, ip: ip, sharingKey: addr.Spec.SharingKey}
+		if old, ok := a.reservations[addr.Name]; ok {
+			r.boundTo = old.boundTo
+		}
+		reservations[addr.Name] = r
+
+		if len(p.inUse[ip.String()]) == 0 {
+			p.inUse[ip.String()] = []string{reservationOwnerPrefix + addr.Name}
+		}
+	}
+
+	// Free the pool slot of any reservation that existed before this
+	// call and isn't in the new set, as long as nothing ever claimed
+	// it. A claimed reservation's slot is already owned by its
+	// binding key, not the placeholder, and releasing that is
+	// Unassign/release's job, not this one's.
+	for name, old := range a.reservations {
+		if _, stillConfigured := reservations[name]; stillConfigured {
+			continue
+		}
+		if len(old.boundTo) != 0 {
+			continue
+		}
+		p, ok := a.pools[old.pool]
+		if !ok {
+			continue
+		}
+		if owners := p.inUse[old.ip.String()]; len(owners) == 1 && owners[0] == reservationOwnerPrefix+name {
+			delete(p.inUse, old.ip.String())
+		}
+	}
+
+	a.reservations = reservations
+	return nil
+}
+
+// ReservedAddress returns the address and family of the named
+// reservation, and whether it exists at all.
+func (a *Allocator) ReservedAddress(name string) (net.IP, Family, bool) {
+	r, ok := a.reservations[name]
+	if !ok {
+		return nil, 0, false
+	}
+	return r.ip, FamilyOf(r.ip), true
+}
+
+// AssignNamed gives key the address reserved under the Address
+// named "name". It fails if no such reservation exists. If the
+// reservation is already bound to a different key, it only succeeds
+// if the reservation has a sharingKey configured and both keys agree
+// on it, the same way pool addresses are shared (see sharingConflict).
+func (a *Allocator) AssignNamed(key, name string, ports []Port, sharingKey string) (string, net.IP, error) {
+	r, ok := a.reservations[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such address %q", name)
+	}
+
+	if len(r.boundTo) > 0 && !ownsSlot(r.boundTo, key) {
+		if r.sharingKey == "" {
+			return "", nil, fmt.Errorf("address %q is already bound to another service", name)
+		}
+		if sharingKey != r.sharingKey {
+			return "", nil, fmt.Errorf("address %q is already bound to another service and is only shared under its own %s", name, purelbv1.SharingAnnotation)
+		}
+		for _, owner := range r.boundTo {
+			if err := a.sharingConflict(owner, FamilyOf(r.ip), ports, sharingKey); err != nil {
+				return "", nil, fmt.Errorf("address %q: %s", name, err)
+			}
+		}
+	}
+
+	p := a.pools[r.pool]
+	if owners := p.inUse[r.ip.String()]; len(owners) == 1 && owners[0] == reservationOwnerPrefix+name {
+		delete(p.inUse, r.ip.String())
+	}
+
+	pool, err := a.assign(key, r.pool, r.ip, ports, sharingKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ownsSlot(r.boundTo, key) {
+		r.boundTo = append(r.boundTo, key)
+	}
+	return pool, r.ip, nil
+}
+
+// reservationFor returns the reservation that owns ip, if any.
+func (a *Allocator) reservationFor(ip net.IP) *reservation {
+	for _, r := range a.reservations {
+		if r.ip.Equal(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// poolName returns the name used for the "other half" of a
+// dual-stack pool pair. The IPv4 half keeps the ServiceGroup's own
+// name so existing single-stack configs and annotations keep
+// working unchanged.
+func poolName(group string, family Family) string {
+	if family == FamilyV6 {
+		return group + "-v6"
+	}
+	return group
+}
+
+func newPool(name, cidr string) (*pool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	return &pool{
+		name:   name,
+		cidr:   n,
+		family: FamilyOf(n.IP),
+		inUse:  map[string][]string{},
+	}, nil
+}
+
+// poolsByFamily returns every configured pool of the given family.
+func (a *Allocator) poolsByFamily(family Family) []*pool {
+	var ret []*pool
+	for _, p := range a.pools {
+		if p.family == family {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// Allocate assigns an available address of the given family to key,
+// bruteforcing across every configured pool of that family. It
+// returns the name of the pool the address came from.
+func (a *Allocator) Allocate(key string, family Family, ports []Port, sharingKey string) (string, net.IP, error) {
+	for _, p := range a.poolsByFamily(family) {
+		ip, err := a.AllocateFromPool(key, p.name, family, ports, sharingKey)
+		if err == nil {
+			return p.name, ip, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no available %s addresses", family)
+}
+
+// AllocateFromPool assigns an available address of the given family
+// from the named pool to key.
+func (a *Allocator) AllocateFromPool(key, poolName string, family Family, ports []Port, sharingKey string) (net.IP, error) {
+	p, ok := a.pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("unknown pool %q", poolName)
+	}
+	if p.family != family {
+		return nil, fmt.Errorf("pool %q is %s, not %s", poolName, p.family, family)
+	}
+
+	if p.clusterset {
+		return a.allocateClusterset(key, p, ports, sharingKey)
+	}
+
+	ip := p.first()
+	if ip == nil {
+		return nil, fmt.Errorf("no available addresses in pool %q", poolName)
+	}
+
+	if _, err := a.assign(key, poolName, ip, ports, sharingKey); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// allocateClusterset handles allocation from a Clusterset-enabled
+// pool, consulting a.broker so that every cluster exporting key
+// ends up with the same address. The first cluster to call this for
+// key picks a free local address as usual; every later call (from
+// this cluster or another) gets that same address back from the
+// broker and assigns it locally without ever touching p.first().
+func (a *Allocator) allocateClusterset(key string, p *pool, ports []Port, sharingKey string) (net.IP, error) {
+	if a.broker == nil {
+		return nil, fmt.Errorf("pool %q is clusterset-enabled but no broker is configured", p.name)
+	}
+
+	ip, allocatedBy, err := a.broker.Allocate(key, a.clusterID, func() (net.IP, error) {
+		ip := p.first()
+		if ip == nil {
+			return nil, fmt.Errorf("no available addresses in pool %q", p.name)
+		}
+		return ip, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := a.assign(key, p.name, ip, ports, sharingKey); err != nil {
+		return nil, err
+	}
+	a.allocated[key][FamilyOf(ip)].clustersetAllocatedBy = allocatedBy
+	return ip, nil
+}
+
+// Assign gives key the specific address ip, as long as it's free or
+// shareable with key's sharing key. It returns the name of the pool
+// that owns ip.
+func (a *Allocator) Assign(key string, ip net.IP, ports []Port, sharingKey string) (string, error) {
+	for _, p := range a.pools {
+		if p.contains(ip) {
+			return a.assign(key, p.name, ip, ports, sharingKey)
+		}
+	}
+	return "", fmt.Errorf("%q is not contained in any configured pool", ip)
+}
+
+func (a *Allocator) assign(key, poolName string, ip net.IP, ports []Port, sharingKey string) (string, error) {
+	p := a.pools[poolName]
+	family := FamilyOf(ip)
+
+	for _, owner := range p.inUse[ip.String()] {
+		if owner == key {
+			continue
+		}
+		if strings.HasPrefix(owner, reservationOwnerPrefix) {
+			return "", fmt.Errorf("address %q is reserved as %q", ip, strings.TrimPrefix(owner, reservationOwnerPrefix))
+		}
+		if err := a.sharingConflict(owner, family, ports, sharingKey); err != nil {
+			return "", fmt.Errorf("address %q: %s", ip, err)
+		}
+	}
+
+	// If key already holds exactly this address, there's nothing to
+	// change. This matters beyond just avoiding churn: for a
+	// Clusterset pool, treating an unchanged reconverge as a release
+	// would incorrectly tell the ClustersetBroker that this cluster
+	// is unexporting the Service.
+	if alloc, ok := a.allocated[key][family]; ok && alloc.pool == poolName && alloc.ip.Equal(ip) {
+		alloc.ports = ports
+		alloc.sharingKey = sharingKey
+		return poolName, nil
+	}
+
+	// release whatever this key previously had allocated for this
+	// family before taking the new address.
+	a.release(key, family)
+
+	if !ownsSlot(p.inUse[ip.String()], key) {
+		p.inUse[ip.String()] = append(p.inUse[ip.String()], key)
+	}
+	if a.allocated[key] == nil {
+		a.allocated[key] = map[Family]*allocation{}
+	}
+	a.allocated[key][family] = &allocation{
+		pool:       poolName,
+		ip:         ip,
+		ports:      ports,
+		sharingKey: sharingKey,
+	}
+
+	return poolName, nil
+}
+
+// sharingConflict returns an error if key can't share owner's
+// allocation of family, because owner didn't request the same
+// sharing key, or because their ports overlap.
+func (a *Allocator) sharingConflict(owner string, family Family, ports []Port, sharingKey string) error {
+	if sharingKey == "" {
+		return fmt.Errorf("already assigned to %q, which isn't shareable", owner)
+	}
+	existing, ok := a.allocated[owner][family]
+	if !ok || existing.sharingKey != sharingKey {
+		return fmt.Errorf("already assigned to %q with a different (or no) %s", owner, purelbv1.SharingAnnotation)
+	}
+	for _, p1 := range existing.ports {
+		for _, p2 := range ports {
+			if p1.Proto == p2.Proto && p1.Port == p2.Port {
+				return fmt.Errorf("port %s/%d conflicts with %q, which already shares this address", p2.Proto, p2.Port, owner)
+			}
+		}
+	}
+	return nil
+}
+
+// ownsSlot reports whether key already appears among owners.
+func ownsSlot(owners []string, key string) bool {
+	for _, owner := range owners {
+		if owner == key {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOwner returns owners with key removed, if present.
+func removeOwner(owners []string, key string) []string {
+	for i, owner := range owners {
+		if owner == key {
+			return append(owners[:i], owners[i+1:]...)
+		}
+	}
+	return owners
+}
+
+// release frees whatever key has allocated for family, if anything.
+func (a *Allocator) release(key string, family Family) bool {
+	allocs, ok := a.allocated[key]
+	if !ok {
+		return false
+	}
+	alloc, ok := allocs[family]
+	if !ok {
+		return false
+	}
+
+	if p, ok := a.pools[alloc.pool]; ok {
+		if p.clusterset && alloc.clustersetAllocatedBy != "" {
+			// Only actually free the pool slot once the broker tells us
+			// we were the last cluster exporting key; otherwise the
+			// other clusters are still serving traffic for it.
+			if lastExporter, err := a.broker.Release(key, a.clusterID); err != nil || !lastExporter {
+				delete(allocs, family)
+				if len(allocs) == 0 {
+					delete(a.allocated, key)
+				}
+				return true
+			}
+		}
+		p.inUse[alloc.ip.String()] = removeOwner(p.inUse[alloc.ip.String()], key)
+		r := a.reservationFor(alloc.ip)
+		if r != nil {
+			r.boundTo = removeOwner(r.boundTo, key)
+		}
+		if len(p.inUse[alloc.ip.String()]) == 0 {
+			delete(p.inUse, alloc.ip.String())
+			if r != nil && len(r.boundTo) == 0 {
+				p.inUse[alloc.ip.String()] = []string{reservationOwnerPrefix + r.name}
+			}
+		}
+	}
+	delete(allocs, family)
+	if len(allocs) == 0 {
+		delete(a.allocated, key)
+	}
+	return true
+}
+
+// UnassignFamily frees whatever address key has allocated for
+// family, leaving any other family's allocation untouched. It
+// returns true if key had an address of that family allocated.
+func (a *Allocator) UnassignFamily(key string, family Family) bool {
+	return a.release(key, family)
+}
+
+// Unassign frees every address that key has allocated. It returns
+// true if key had anything allocated.
+func (a *Allocator) Unassign(key string) bool {
+	allocs, ok := a.allocated[key]
+	if !ok {
+		return false
+	}
+	for family := range allocs {
+		a.release(key, family)
+	}
+	return true
+}
+
+// PoolFor returns the name of the pool that key's family allocation
+// came from, or "" if key has no address of that family.
+func (a *Allocator) PoolFor(key string, family Family) string {
+	alloc, ok := a.allocated[key][family]
+	if !ok {
+		return ""
+	}
+	return alloc.pool
+}
+
+// IPFor returns the address that key has allocated for family, or
+// nil if it has none.
+func (a *Allocator) IPFor(key string, family Family) net.IP {
+	alloc, ok := a.allocated[key][family]
+	if !ok {
+		return nil
+	}
+	return alloc.ip
+}
+
+// PoolClustersetEnabled reports whether the named pool coordinates
+// allocation across clusters through a ClustersetBroker.
+func (a *Allocator) PoolClustersetEnabled(poolName string) bool {
+	p, ok := a.pools[poolName]
+	return ok && p.clusterset
+}
+
+// AllPoolsClustersetEnabled reports whether every configured pool of
+// the given family coordinates allocation across clusters through a
+// ClustersetBroker. It's false if there are no pools of that family
+// at all, since a bruteforce allocation of that family can't be
+// guaranteed to land in a Clusterset-enabled pool.
+func (a *Allocator) AllPoolsClustersetEnabled(family Family) bool {
+	pools := a.poolsByFamily(family)
+	if len(pools) == 0 {
+		return false
+	}
+	for _, p := range pools {
+		if !p.clusterset {
+			return false
+		}
+	}
+	return true
+}
+
+// ClustersetAllocatedBy returns the ID of the cluster that first
+// allocated key's address through a ClustersetBroker, or "" if key
+// has no address, or its address didn't come from a Clusterset-
+// enabled pool.
+func (a *Allocator) ClustersetAllocatedBy(key string) string {
+	for _, alloc := range a.allocated[key] {
+		if alloc.clustersetAllocatedBy != "" {
+			return alloc.clustersetAllocatedBy
+		}
+	}
+	return ""
+}
+
+// Allocated reports whether key currently owns at least one
+// allocated address.
+func (a *Allocator) Allocated(key string) bool {
+	return len(a.allocated[key]) > 0
+}
+
+// Families returns the address families that key currently has
+// allocated.
+func (a *Allocator) Families(key string) []Family {
+	var ret []Family
+	for family := range a.allocated[key] {
+		ret = append(ret, family)
+	}
+	return ret
+}
+
+// IPs returns the addresses that key currently has allocated, one
+// per family, in no particular order.
+func (a *Allocator) IPs(key string) []net.IP {
+	var ret []net.IP
+	for _, alloc := range a.allocated[key] {
+		ret = append(ret, alloc.ip)
+	}
+	return ret
+}
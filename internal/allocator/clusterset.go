@@ -0,0 +1,116 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ClustersetBroker coordinates allocation of addresses, across
+// clusters, for a ServiceGroup whose pool is in Clusterset mode. The
+// Allocator consults a ClustersetBroker from AllocateFromPool
+// whenever the target pool is Clusterset-enabled, so that every
+// cluster exporting the same Service ends up announcing the same
+// address.
+//
+// The only implementation here so far is memoryClustersetBroker, an
+// in-process stand-in for tests and single-cluster deployments. A
+// production multi-cluster deployment needs a real implementation
+// backed by something all clusters can see, e.g. a lease-like CR in
+// a designated broker namespace; that belongs alongside the rest of
+// the k8s client code and hasn't been written yet. This interface
+// exists so that it, or another coordination backend (etcd, Consul,
+// ...), can be dropped in without touching the Allocator.
+type ClustersetBroker interface {
+	// Allocate coordinates allocation of key's address. If no cluster
+	// has allocated key yet, Allocate calls assign to obtain a local
+	// address, records clusterID as the allocating cluster, and
+	// returns that address with allocatedBy equal to clusterID. If
+	// key is already allocated, Allocate returns the recorded address
+	// and the ID of the cluster that allocated it (without calling
+	// assign), and adds clusterID to the set of clusters currently
+	// exporting key.
+	Allocate(key, clusterID string, assign func() (net.IP, error)) (ip net.IP, allocatedBy string, err error)
+
+	// Release removes clusterID from the set of clusters exporting
+	// key. It reports whether clusterID was the last exporter, in
+	// which case the broker has forgotten key's allocation entirely
+	// and its address is free for reallocation. If the allocating
+	// cluster releases while other clusters are still exporting key,
+	// the record (and its address) persists for them.
+	Release(key, clusterID string) (lastExporter bool, err error)
+}
+
+// clustersetRecord is the state a ClustersetBroker keeps for one
+// coordinated allocation.
+type clustersetRecord struct {
+	ip          net.IP
+	allocatedBy string
+	exportedBy  map[string]bool
+}
+
+// memoryClustersetBroker is an in-process ClustersetBroker. It's a
+// reference implementation, useful for tests and for single-cluster
+// deployments that enable Clusterset mode without a real multi-
+// cluster broker behind it.
+type memoryClustersetBroker struct {
+	mu      sync.Mutex
+	records map[string]*clustersetRecord
+}
+
+// NewMemoryClustersetBroker returns a ClustersetBroker backed by an
+// in-process map.
+func NewMemoryClustersetBroker() ClustersetBroker {
+	return &memoryClustersetBroker{records: map[string]*clustersetRecord{}}
+}
+
+func (b *memoryClustersetBroker) Allocate(key, clusterID string, assign func() (net.IP, error)) (net.IP, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.records[key]; ok {
+		r.exportedBy[clusterID] = true
+		return r.ip, r.allocatedBy, nil
+	}
+
+	ip, err := assign()
+	if err != nil {
+		return nil, "", err
+	}
+	b.records[key] = &clustersetRecord{
+		ip:          ip,
+		allocatedBy: clusterID,
+		exportedBy:  map[string]bool{clusterID: true},
+	}
+	return ip, clusterID, nil
+}
+
+func (b *memoryClustersetBroker) Release(key, clusterID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	r, ok := b.records[key]
+	if !ok {
+		return false, fmt.Errorf("no clusterset allocation for %q", key)
+	}
+	delete(r.exportedBy, clusterID)
+	if len(r.exportedBy) == 0 {
+		delete(b.records, key)
+		return true, nil
+	}
+	return false, nil
+}
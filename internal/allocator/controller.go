@@ -33,6 +33,7 @@ type Controller interface {
 	SetConfig(*purelbv1.Config) k8s.SyncState
 	SetBalancer(string, *v1.Service, *v1.Endpoints) k8s.SyncState
 	DeleteBalancer(string) k8s.SyncState
+	SetAnnouncingNode(name, node string)
 	MarkSynced()
 	Shutdown()
 }
@@ -44,14 +45,20 @@ type controller struct {
 	baseURL  *url.URL
 	groupURL *string
 	logger   log.Logger
+
+	// announcing records, for each Service key, the node last reported
+	// via SetAnnouncingNode as currently serving its address. It's read
+	// by SetBalancer to populate purelbv1.StatusNodeAnnotation.
+	announcing map[string]string
 }
 
 // NewController configures a new controller. If error is non-nil then
 // the controller object shouldn't be used.
 func NewController(l log.Logger, ips *Allocator) (Controller, error) {
 	con := &controller{
-		logger: l,
-		ips:    ips,
+		logger:     l,
+		ips:        ips,
+		announcing: map[string]string{},
 	}
 
 	return con, nil
@@ -65,9 +72,26 @@ func (c *controller) DeleteBalancer(name string) k8s.SyncState {
 	if c.ips.Unassign(name) {
 		c.logger.Log("event", "serviceDeleted", "msg", "service deleted")
 	}
+	delete(c.announcing, name)
 	return k8s.SyncStateReprocessAll
 }
 
+// SetAnnouncingNode records that node is the one currently
+// announcing name's address, so that the next SetBalancer call for
+// name can publish it in purelbv1.StatusNodeAnnotation.
+func (c *controller) SetAnnouncingNode(name, node string) {
+	if c.announcing == nil {
+		c.announcing = map[string]string{}
+	}
+	c.announcing[name] = node
+}
+
+// isAllocated reports whether name currently owns an allocated
+// address, according to the Allocator's ownership map.
+func (c *controller) isAllocated(name string) bool {
+	return c.ips.Allocated(name)
+}
+
 func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 	defer c.logger.Log("event", "configUpdated")
 
@@ -81,6 +105,11 @@ func (c *controller) SetConfig(cfg *purelbv1.Config) k8s.SyncState {
 		return k8s.SyncStateError
 	}
 
+	if err := c.ips.SetReservations(cfg.Addresses); err != nil {
+		c.logger.Log("op", "setConfig", "error", err)
+		return k8s.SyncStateError
+	}
+
 	// see if there's an EGW config. if so then we'll announce new
 	// services to the EGW
 	c.groupURL = nil
@@ -111,4 +140,4 @@ func (c *controller) MarkSynced() {
 
 func (c *controller) Shutdown() {
 	c.logger.Log("event", "shutdown")
-}
\ No newline at end of file
+}
@@ -135,8 +135,10 @@ func TestControllerConfig(t *testing.T) {
 	wantSvc.Status = statusAssigned("1.2.3.0")
 	wantSvc.ObjectMeta = metav1.ObjectMeta{
 		Annotations: map[string]string{
-			purelbv1.BrandAnnotation: purelbv1.Brand,
-			purelbv1.PoolAnnotation:  "default",
+			purelbv1.BrandAnnotation:        purelbv1.Brand,
+			purelbv1.PoolAnnotation:         "default",
+			purelbv1.StatusPoolAnnotation:   "default",
+			purelbv1.StatusFamilyAnnotation: FamilyV4.String(),
 		},
 	}
 
@@ -201,8 +203,899 @@ func TestDeleteRecyclesIP(t *testing.T) {
 	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test2", svc2, nil), "SetBalancer svc2 failed")
 	assert.NotEmpty(t, svc2.Status.LoadBalancer.Ingress, "svc2 didn't get an IP")
 	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 got the wrong IP")
+}
+
+func requireDualStack() *v1.IPFamilyPolicyType {
+	p := v1.IPFamilyPolicyRequireDualStack
+	return &p
+}
+
+func dualStackConfig() *purelbv1.Config {
+	return &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool:  "1.2.3.0/24",
+						Pool6: "fd00::/120",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDualStackAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(dualStackConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			ClusterIPs:     []string{"1.2.3.4", "fd00::4"},
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Len(t, svc.Status.LoadBalancer.Ingress, 2, "dual-stack service should get two addresses")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "wrong IPv4 address")
+	assert.Equal(t, "fd00::", svc.Status.LoadBalancer.Ingress[1].IP, "wrong IPv6 address")
+
+	// Switching back to single-stack should release the IPv6 half.
+	svc.Spec.IPFamilyPolicy = nil
+	svc.Spec.IPFamilies = nil
+	svc.Spec.ClusterIPs = nil
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.0"}}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetBalancer("test", svc, nil), "releasing a family should trigger a reprocess")
+	assert.Equal(t, []Family{FamilyV4}, c.ips.Families("test"), "IPv6 address was not released")
+}
+
+func TestDualStackPartialFailureRollsBack(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	// Only one IPv6 address available; a second dual-stack service
+	// should fail to get an IPv6 address and should not keep the
+	// IPv4 address it grabbed along the way.
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool:  "1.2.3.0/24",
+						Pool6: "fd00::/128",
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc1", svc1, nil), "SetBalancer svc1 failed")
+	assert.Len(t, svc1.Status.LoadBalancer.Ingress, 2, "svc1 should have gotten two addresses")
+
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.5",
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Empty(t, svc2.Status.LoadBalancer.Ingress, "svc2 should not have gotten a partial allocation")
+	assert.Empty(t, c.ips.Families("svc2"), "svc2's IPv4 address should have been rolled back")
+}
+
+func TestFamilyMismatchedLoadBalancerIP(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(dualStackConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			LoadBalancerIP: "fd00::1",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer should converge, not error")
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress, "service requesting a mismatched family should not get an address")
+	assert.True(t, k.loggedWarning, "family mismatch should have been logged as a warning event")
+}
+
+// TestDualStackAllocationAcrossMixedPools covers a dual-stack
+// service whose two families come from separate, single-family
+// ServiceGroups (no Pool6 pairing), as opposed to the paired-pool
+// case in TestDualStackAllocation.
+func TestDualStackAllocationAcrossMixedPools(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(mixedPoolDualStackConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			ClusterIPs:     []string{"1.2.3.4", "fd00::4"},
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Len(t, svc.Status.LoadBalancer.Ingress, 2, "dual-stack service should get two addresses")
+	assert.Equal(t, "1.2.3.0", svc.Status.LoadBalancer.Ingress[0].IP, "wrong IPv4 address")
+	assert.Equal(t, "fd00::", svc.Status.LoadBalancer.Ingress[1].IP, "wrong IPv6 address")
+}
+
+func mixedPoolDualStackConfig() *purelbv1.Config {
+	return &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "v4-pool"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/24",
+					},
+				},
+			},
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "v6-pool"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "fd00::/120",
+					},
+				},
+			},
+		},
 	}
-	if len(svc2.Status.LoadBalancer.Ingress) == 0 || svc2.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
-		t.Fatal("svc2 didn't get an IP")
+}
+
+func TestReleaseOnAnnotationChangeReprocessesPending(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
 	}
+
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/32",
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc1", svc1, nil), "SetBalancer svc1 failed")
+	assert.Equal(t, "1.2.3.0", svc1.Status.LoadBalancer.Ingress[0].IP, "svc1 got the wrong IP")
+	k.reset()
+
+	// svc2 is queued but the pool is exhausted, so it gets no address.
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Empty(t, svc2.Status.LoadBalancer.Ingress, "svc2 shouldn't have gotten an IP yet")
+
+	// The operator points svc1 at a pool that doesn't exist, which
+	// makes svc1 release its address without an explicit delete.
+	svc1.Annotations[purelbv1.DesiredPoolAnnotation] = "nonexistent"
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetBalancer("svc1", svc1, nil), "SetBalancer should have told us to reprocess")
+	assert.Empty(t, svc1.Status.LoadBalancer.Ingress, "svc1 should have lost its IP")
+
+	// Now svc2 should be able to grab the freed slot, without us
+	// ever calling DeleteBalancer.
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 didn't get the freed IP")
+}
+
+func TestReassignToNewPoolReprocessesPending(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool-a"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/32",
+					},
+				},
+			},
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool-b"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.4.0/32",
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	// svc1 starts out in pool-a, taking its only address.
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.DesiredPoolAnnotation: "pool-a"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc1", svc1, nil), "SetBalancer svc1 failed")
+	assert.Equal(t, "1.2.3.0", svc1.Status.LoadBalancer.Ingress[0].IP, "svc1 got the wrong IP")
+	k.reset()
+
+	// svc2 wants pool-a specifically, but it's exhausted, so svc2 is
+	// queued with no address.
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.DesiredPoolAnnotation: "pool-a"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Empty(t, svc2.Status.LoadBalancer.Ingress, "svc2 shouldn't have gotten an IP yet")
+
+	// The operator points svc1 at pool-b instead, a different pool
+	// that's still valid and has room. svc1 should reconverge onto
+	// pool-b's address, which frees its pool-a address for svc2 even
+	// though svc1 never drops to zero addresses in between.
+	svc1.Annotations[purelbv1.DesiredPoolAnnotation] = "pool-b"
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetBalancer("svc1", svc1, nil), "SetBalancer should have told us to reprocess")
+	assert.Equal(t, "1.2.4.0", svc1.Status.LoadBalancer.Ingress[0].IP, "svc1 should have moved to pool-b's address")
+
+	// Now svc2 should be able to grab the slot svc1 vacated in
+	// pool-a, without us ever calling DeleteBalancer.
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Equal(t, "1.2.3.0", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 didn't get the freed IP")
+}
+
+func namedAddressConfig() *purelbv1.Config {
+	return &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/24",
+					},
+				},
+			},
+		},
+		Addresses: []*purelbv1.Address{
+			&purelbv1.Address{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-vip"},
+				Spec: purelbv1.AddressSpec{
+					Pool:    "default",
+					Address: "1.2.3.100",
+				},
+			},
+		},
+	}
+}
+
+func TestNamedAddressReservation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(namedAddressConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	// A Service that bruteforces across the pool should never land on
+	// the reserved address, even though it's never been claimed.
+	roaming := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("roaming", roaming, nil), "SetBalancer roaming failed")
+	assert.NotEqual(t, "1.2.3.100", roaming.Status.LoadBalancer.Ingress[0].IP, "bruteforce allocation landed on a reserved address")
+
+	// A Service that asks for the reservation by name gets it.
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.5"},
+	}
+	svc.Annotations = map[string]string{purelbv1.AddressNameAnnotation: "my-vip"}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("named", svc, nil), "SetBalancer named failed")
+	assert.Equal(t, "1.2.3.100", svc.Status.LoadBalancer.Ingress[0].IP, "named service didn't get the reserved address")
+
+	// A second Service asking for the same name is refused.
+	other := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.6"},
+	}
+	other.Annotations = map[string]string{purelbv1.AddressNameAnnotation: "my-vip"}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("other", other, nil), "SetBalancer other failed")
+	assert.Empty(t, other.Status.LoadBalancer.Ingress, "a second service shouldn't be able to claim an already-bound reservation")
+	assert.True(t, k.loggedWarning, "conflicting reservation claim should have logged a warning")
+
+	// Deleting the named Service frees the reservation's accounting,
+	// but the Address object itself (and the pool slot) stays
+	// reserved rather than becoming available to bruteforce.
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.DeleteBalancer("named"), "DeleteBalancer didn't ask for a reprocess")
+	k.reset()
+	again := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.7"},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("again", again, nil), "SetBalancer again failed")
+	assert.NotEqual(t, "1.2.3.100", again.Status.LoadBalancer.Ingress[0].IP, "released reservation was handed out by bruteforce")
+
+	// But the name can be claimed again.
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.8"},
+	}
+	svc2.Annotations = map[string]string{purelbv1.AddressNameAnnotation: "my-vip"}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("named2", svc2, nil), "SetBalancer named2 failed")
+	assert.Equal(t, "1.2.3.100", svc2.Status.LoadBalancer.Ingress[0].IP, "reservation should be claimable again after release")
+}
+
+func sharedNamedAddressConfig() *purelbv1.Config {
+	return &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/24",
+					},
+				},
+			},
+		},
+		Addresses: []*purelbv1.Address{
+			&purelbv1.Address{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-vip"},
+				Spec: purelbv1.AddressSpec{
+					Pool:       "default",
+					Address:    "1.2.3.100",
+					SharingKey: "vip-key",
+				},
+			},
+		},
+	}
+}
+
+func TestSharedNamedAddressReservation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(sharedNamedAddressConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+			Ports:     []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				purelbv1.AddressNameAnnotation: "my-vip",
+				purelbv1.SharingAnnotation:     "vip-key",
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc1", svc1, nil), "SetBalancer svc1 failed")
+	assert.Equal(t, "1.2.3.100", svc1.Status.LoadBalancer.Ingress[0].IP, "svc1 didn't get the reserved address")
+
+	// svc2 asks for the same reservation, with the sharing key the
+	// Address requires and a non-conflicting port, so it's allowed in.
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.6",
+			Ports:     []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 443}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				purelbv1.AddressNameAnnotation: "my-vip",
+				purelbv1.SharingAnnotation:     "vip-key",
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Equal(t, "1.2.3.100", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 didn't get to share the reservation")
+
+	// svc3 asks for the same reservation with a conflicting port, so
+	// it's refused even though the sharing key matches.
+	svc3 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.7",
+			Ports:     []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				purelbv1.AddressNameAnnotation: "my-vip",
+				purelbv1.SharingAnnotation:     "vip-key",
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc3", svc3, nil), "SetBalancer svc3 should not have errored out")
+	assert.Empty(t, svc3.Status.LoadBalancer.Ingress, "svc3 shouldn't have gotten a conflicting-port shared reservation")
+	assert.True(t, k.loggedWarning, "svc3's port conflict should have logged a warning")
+	k.reset()
+
+	// svc4 asks for the same reservation without a sharing key, so
+	// it's refused outright.
+	svc4 := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.8"},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.AddressNameAnnotation: "my-vip"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc4", svc4, nil), "SetBalancer svc4 should not have errored out")
+	assert.Empty(t, svc4.Status.LoadBalancer.Ingress, "svc4 shouldn't have gotten an unshared reservation")
+	assert.True(t, k.loggedWarning, "svc4's missing sharing key should have logged a warning")
+
+	// Once both sharing services release it, the reservation goes
+	// back to being an unclaimed placeholder, not left owned by
+	// whichever of them happened to release last.
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.DeleteBalancer("svc1"), "DeleteBalancer svc1 didn't ask for a reprocess")
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.DeleteBalancer("svc2"), "DeleteBalancer svc2 didn't ask for a reprocess")
+	roaming := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.9"},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("roaming", roaming, nil), "SetBalancer roaming failed")
+	assert.NotEqual(t, "1.2.3.100", roaming.Status.LoadBalancer.Ingress[0].IP, "bruteforce allocation landed on a reserved address after both sharers released it")
+}
+
+func TestStatusAnnotations(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(dualStackConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			ClusterIPs:     []string{"1.2.3.4", "fd00::4"},
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	svc.Annotations = map[string]string{purelbv1.SharingAnnotation: "my-shared-key"}
+
+	// Before any node has announced the address, there's no node
+	// annotation to publish.
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Equal(t, "default,default", svc.Annotations[purelbv1.StatusPoolAnnotation], "wrong pool status annotation")
+	assert.Equal(t, "IPv4,IPv6", svc.Annotations[purelbv1.StatusFamilyAnnotation], "wrong family status annotation")
+	assert.NotEmpty(t, svc.Annotations[purelbv1.StatusSharingKeyHashAnnotation], "sharing key hash should have been recorded")
+	assert.NotContains(t, svc.Annotations, purelbv1.StatusNodeAnnotation, "node annotation shouldn't be set before any node announces")
+
+	// Once the announcer reports a node, the next convergence should
+	// publish it.
+	c.SetAnnouncingNode("test", "node-a")
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Equal(t, "node-a", svc.Annotations[purelbv1.StatusNodeAnnotation], "wrong node status annotation")
+
+	// Switching back to single-stack releases the IPv6 half and
+	// should drop its contribution from the status annotations.
+	svc.Spec.IPFamilyPolicy = nil
+	svc.Spec.IPFamilies = nil
+	svc.Spec.ClusterIPs = nil
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: svc.Status.LoadBalancer.Ingress[0].IP}}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Equal(t, "default", svc.Annotations[purelbv1.StatusPoolAnnotation], "pool status annotation wasn't trimmed to the surviving family")
+	assert.Equal(t, "IPv4", svc.Annotations[purelbv1.StatusFamilyAnnotation], "family status annotation wasn't trimmed to the surviving family")
+}
+
+// TestMixedPoolStatusAnnotationOrdering regression-tests the status
+// annotations specifically, once a dual-stack address is already
+// allocated from two independent, single-family pools (see
+// TestDualStackAllocationAcrossMixedPools for the allocation itself).
+func TestMixedPoolStatusAnnotationOrdering(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(mixedPoolDualStackConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "1.2.3.4",
+			ClusterIPs:     []string{"1.2.3.4", "fd00::4"},
+			IPFamilyPolicy: requireDualStack(),
+			IPFamilies:     []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "SetBalancer failed")
+	assert.Equal(t, "v4-pool,v6-pool", svc.Annotations[purelbv1.StatusPoolAnnotation], "wrong pool status annotation")
+	assert.Equal(t, "IPv4,IPv6", svc.Annotations[purelbv1.StatusFamilyAnnotation], "wrong family status annotation")
+
+	// Reconverging without anything having changed must not reorder
+	// the status annotations, even though c.ips tracks each family's
+	// allocation in a map with no inherent order.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("test", svc, nil), "no-op SetBalancer failed")
+		assert.Equal(t, "v4-pool,v6-pool", svc.Annotations[purelbv1.StatusPoolAnnotation], "pool status annotation reordered on a no-op reconcile")
+		assert.Equal(t, "IPv4,IPv6", svc.Annotations[purelbv1.StatusFamilyAnnotation], "family status annotation reordered on a no-op reconcile")
+	}
+}
+
+func TestDeletedReservationFreesUnclaimedAddress(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(namedAddressConfig()), "SetConfig failed")
+	c.MarkSynced()
+
+	// Nobody has claimed "my-vip" yet, but bruteforce allocation
+	// still has to skip over its address.
+	roaming := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("roaming", roaming, nil), "SetBalancer roaming failed")
+	assert.NotEqual(t, "1.2.3.100", roaming.Status.LoadBalancer.Ingress[0].IP, "bruteforce allocation landed on a reserved address")
+
+	// The operator deletes the Address CR before anything ever
+	// claimed it. Its pool slot must come back for allocation, not
+	// leak forever.
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(&purelbv1.Config{
+		Groups: namedAddressConfig().Groups,
+	}), "SetConfig removing the reservation failed")
+
+	claimant := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.5", LoadBalancerIP: "1.2.3.100"},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("claimant", claimant, nil), "SetBalancer claimant failed")
+	assert.Equal(t, "1.2.3.100", claimant.Status.LoadBalancer.Ingress[0].IP, "previously-reserved address was never freed after its reservation was deleted")
+}
+
+func TestSharedIPAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "default"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/24",
+					},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "10.0.0.1",
+			LoadBalancerIP: "1.2.3.5",
+			Ports:          []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.SharingAnnotation: "shared-key"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc1", svc1, nil), "SetBalancer svc1 failed")
+	assert.Equal(t, "1.2.3.5", svc1.Status.LoadBalancer.Ingress[0].IP, "svc1 didn't get its requested IP")
+
+	// svc2 requests the same IP, with the same sharing key and
+	// non-conflicting ports, so it should be allowed to share it.
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "10.0.0.2",
+			LoadBalancerIP: "1.2.3.5",
+			Ports:          []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 443}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.SharingAnnotation: "shared-key"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc2", svc2, nil), "SetBalancer svc2 failed")
+	assert.Equal(t, "1.2.3.5", svc2.Status.LoadBalancer.Ingress[0].IP, "svc2 didn't get to share svc1's IP")
+
+	// svc3 requests the same IP with a conflicting port, so it should
+	// be rejected even though the sharing key matches.
+	svc3 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "10.0.0.3",
+			LoadBalancerIP: "1.2.3.5",
+			Ports:          []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{purelbv1.SharingAnnotation: "shared-key"},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc3", svc3, nil), "SetBalancer svc3 should not have errored out")
+	assert.Empty(t, svc3.Status.LoadBalancer.Ingress, "svc3 shouldn't have gotten a conflicting-port shared IP")
+	assert.True(t, k.loggedWarning, "svc3's port conflict should have logged a warning")
+	k.reset()
+
+	// svc4 requests the same IP without a sharing key at all, so it
+	// should be rejected outright.
+	svc4 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:           "LoadBalancer",
+			ClusterIP:      "10.0.0.4",
+			LoadBalancerIP: "1.2.3.5",
+		},
+	}
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("svc4", svc4, nil), "SetBalancer svc4 should not have errored out")
+	assert.Empty(t, svc4.Status.LoadBalancer.Ingress, "svc4 shouldn't have gotten an unshared IP")
+	assert.True(t, k.loggedWarning, "svc4's missing sharing key should have logged a warning")
+}
+
+func clustersetConfig() *purelbv1.Config {
+	return &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{
+						Pool: "1.2.3.0/24",
+					},
+					Clusterset: &purelbv1.ServiceGroupClustersetSpec{},
+				},
+			},
+		},
+	}
+}
+
+func newClustersetController(t *testing.T, k *testK8S, clusterID string, broker ClustersetBroker) *controller {
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+	c.ips.SetClusterset(clusterID, broker)
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(clustersetConfig()), "SetConfig failed")
+	c.MarkSynced()
+	return c
+}
+
+func TestClustersetConcurrentAllocation(t *testing.T) {
+	broker := NewMemoryClustersetBroker()
+	k1, k2 := &testK8S{t: t}, &testK8S{t: t}
+	cluster1 := newClustersetController(t, k1, "cluster-1", broker)
+	cluster2 := newClustersetController(t, k2, "cluster-2", broker)
+
+	newSvc := func() *v1.Service {
+		return &v1.Service{
+			Spec:       v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{purelbv1.DesiredPoolAnnotation: "shared"}},
+		}
+	}
+
+	// Both clusters export the same Service (same key). Whichever
+	// allocates first should "win"; the other should converge to the
+	// exact same address without consuming a different slot in its
+	// own pool.
+	svc1 := newSvc()
+	assert.Equal(t, k8s.SyncStateSuccess, cluster1.SetBalancer("ns/svc", svc1, nil), "cluster1 SetBalancer failed")
+	assert.NotEmpty(t, svc1.Status.LoadBalancer.Ingress, "cluster1 didn't get an address")
+
+	svc2 := newSvc()
+	assert.Equal(t, k8s.SyncStateSuccess, cluster2.SetBalancer("ns/svc", svc2, nil), "cluster2 SetBalancer failed")
+	assert.NotEmpty(t, svc2.Status.LoadBalancer.Ingress, "cluster2 didn't get an address")
+
+	assert.Equal(t, svc1.Status.LoadBalancer.Ingress[0].IP, svc2.Status.LoadBalancer.Ingress[0].IP, "clusters disagreed about the shared VIP")
+	assert.Equal(t, "cluster-1", svc1.Annotations[purelbv1.ClustersetIPAllocatedByAnnotation], "wrong allocating cluster recorded")
+	assert.Equal(t, "cluster-1", svc2.Annotations[purelbv1.ClustersetIPAllocatedByAnnotation], "wrong allocating cluster recorded")
+
+	// A different Service, allocated only by cluster2, should land on
+	// a different address and record cluster2 as the allocator.
+	other := newSvc()
+	other.Spec.ClusterIP = "1.2.3.5"
+	assert.Equal(t, k8s.SyncStateSuccess, cluster2.SetBalancer("ns/other", other, nil), "cluster2 SetBalancer for other failed")
+	assert.NotEqual(t, svc1.Status.LoadBalancer.Ingress[0].IP, other.Status.LoadBalancer.Ingress[0].IP, "unrelated services collided on one address")
+	assert.Equal(t, "cluster-2", other.Annotations[purelbv1.ClustersetIPAllocatedByAnnotation], "wrong allocating cluster recorded")
+}
+
+func TestClustersetAllocatingClusterDeparture(t *testing.T) {
+	broker := NewMemoryClustersetBroker()
+	k1, k2 := &testK8S{t: t}, &testK8S{t: t}
+	cluster1 := newClustersetController(t, k1, "cluster-1", broker)
+	cluster2 := newClustersetController(t, k2, "cluster-2", broker)
+
+	newSvc := func() *v1.Service {
+		return &v1.Service{
+			Spec:       v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{purelbv1.DesiredPoolAnnotation: "shared"}},
+		}
+	}
+
+	svc1 := newSvc()
+	assert.Equal(t, k8s.SyncStateSuccess, cluster1.SetBalancer("ns/svc", svc1, nil), "cluster1 SetBalancer failed")
+	vip := svc1.Status.LoadBalancer.Ingress[0].IP
+
+	svc2 := newSvc()
+	assert.Equal(t, k8s.SyncStateSuccess, cluster2.SetBalancer("ns/svc", svc2, nil), "cluster2 SetBalancer failed")
+	assert.Equal(t, vip, svc2.Status.LoadBalancer.Ingress[0].IP, "cluster2 didn't converge on the allocating cluster's VIP")
+
+	// The allocating cluster (cluster1) unexports the Service first.
+	// The record, and the address, should persist for cluster2.
+	cluster1.DeleteBalancer("ns/svc")
+
+	svc2again := newSvc()
+	assert.Equal(t, k8s.SyncStateSuccess, cluster2.SetBalancer("ns/svc", svc2again, nil), "cluster2 SetBalancer after cluster1 left failed")
+	assert.Equal(t, vip, svc2again.Status.LoadBalancer.Ingress[0].IP, "address should have persisted after the allocating cluster left")
+
+	// Once cluster2, the last exporter, also unexports, the address
+	// should become available for reallocation.
+	cluster2.DeleteBalancer("ns/svc")
+
+	fresh := newSvc()
+	fresh.Spec.ClusterIP = "1.2.3.6"
+	assert.Equal(t, k8s.SyncStateSuccess, cluster1.SetBalancer("ns/fresh", fresh, nil), "cluster1 SetBalancer for fresh service failed")
+	assert.NotEmpty(t, fresh.Status.LoadBalancer.Ingress, "fresh service didn't get an address")
+}
+
+func TestClustersetEnablementConflict(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+	// This cluster's copy of the "shared" group has no Clusterset
+	// block, even though the Service was previously allocated by a
+	// cluster that did have it enabled.
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{Pool: "1.2.3.0/24"},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			purelbv1.DesiredPoolAnnotation:             "shared",
+			purelbv1.ClustersetIPAllocatedByAnnotation: "cluster-1",
+		}},
+	}
+
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("ns/svc", svc, nil), "SetBalancer should converge, not error")
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress, "conflicting enablement should not have allocated an address")
+	assert.True(t, k.loggedWarning, "enablement conflict should have logged a warning event")
+}
+
+func TestClustersetEnablementConflictBruteforce(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		logger: log.NewNopLogger(),
+		ips:    New(),
+		client: k,
+	}
+	// Two same-family pools, neither Clusterset-enabled in this
+	// cluster, even though the Service was previously allocated by a
+	// cluster that had Clusterset enabled somewhere.
+	cfg := &purelbv1.Config{
+		Groups: []*purelbv1.ServiceGroup{
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool-a"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{Pool: "1.2.3.0/24"},
+				},
+			},
+			&purelbv1.ServiceGroup{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool-b"},
+				Spec: purelbv1.ServiceGroupSpec{
+					Local: &purelbv1.ServiceGroupLocalSpec{Pool: "1.2.4.0/24"},
+				},
+			},
+		},
+	}
+	assert.Equal(t, k8s.SyncStateReprocessAll, c.SetConfig(cfg), "SetConfig failed")
+	c.MarkSynced()
+
+	// No DesiredPoolAnnotation: svc bruteforces across both pools, so
+	// even though neither is named explicitly, the stale
+	// ClustersetIPAllocatedByAnnotation should still block it since
+	// it could land in either one.
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{Type: "LoadBalancer", ClusterIP: "1.2.3.4"},
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			purelbv1.ClustersetIPAllocatedByAnnotation: "cluster-1",
+		}},
+	}
+
+	assert.Equal(t, k8s.SyncStateSuccess, c.SetBalancer("ns/svc", svc, nil), "SetBalancer should converge, not error")
+	assert.Empty(t, svc.Status.LoadBalancer.Ingress, "conflicting enablement should not have allocated an address even without a desired pool")
+	assert.True(t, k.loggedWarning, "enablement conflict should have logged a warning event")
 }
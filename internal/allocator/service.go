@@ -16,25 +16,58 @@
 package allocator
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 
 	"k8s.io/api/core/v1"
 
 	"purelb.io/internal/acnodal"
 	"purelb.io/internal/k8s"
+	purelbv1 "purelb.io/pkg/apis/v1"
 )
 
-const (
-	brand                 string = "PureLB"
-	brandAnnotation       string = "purelb.io/allocated-by"
-	poolAnnotation        string = "purelb.io/allocated-from"
-	sharingAnnotation     string = "purelb.io/allow-shared-ip"
-	desiredPoolAnnotation string = "purelb.io/address-pool"
-	groupAnnotation       string = "acnodal.io/groupURL"
-	serviceAnnotation     string = "acnodal.io/serviceURL"
-	endpointAnnotation    string = "acnodal.io/endpointcreateURL"
-)
+// desiredFamilies returns the address families that svc wants an
+// ingress address for. A single-stack Service wants one family,
+// inferred from its ClusterIP; a PreferDualStack or RequireDualStack
+// Service wants one address per family listed in IPFamilies.
+func desiredFamilies(svc *v1.Service) []Family {
+	policy := v1.IPFamilyPolicyType(v1.IPFamilyPolicySingleStack)
+	if svc.Spec.IPFamilyPolicy != nil {
+		policy = *svc.Spec.IPFamilyPolicy
+	}
+
+	if policy == v1.IPFamilyPolicySingleStack || len(svc.Spec.IPFamilies) < 2 {
+		clusterIP := net.ParseIP(svc.Spec.ClusterIP)
+		if clusterIP == nil {
+			return nil
+		}
+		return []Family{FamilyOf(clusterIP)}
+	}
+
+	var families []Family
+	seen := map[Family]bool{}
+	for _, f := range svc.Spec.IPFamilies {
+		family := FamilyV4
+		if f == v1.IPv6Protocol {
+			family = FamilyV6
+		}
+		if !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// releasedAddress is a snapshot of the pool and IP a family had
+// allocated before SetBalancer released it to reallocate.
+type releasedAddress struct {
+	pool string
+	ip   net.IP
+}
 
 func (c *controller) SetBalancer(name string, svc *v1.Service, _ *v1.Endpoints) k8s.SyncState {
 	if !c.synced {
@@ -42,42 +75,115 @@ func (c *controller) SetBalancer(name string, svc *v1.Service, _ *v1.Endpoints)
 		return k8s.SyncStateError
 	}
 
-	// If the ClusterIP is malformed or not set we can't determine the
-	// ipFamily to use.
-	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
-	if clusterIP == nil {
+	// Snapshot whether this service currently holds an address, so we
+	// can tell afterward whether converging it released a slot that
+	// another, still-pending service could use.
+	wasAllocated := c.isAllocated(name)
+
+	families := desiredFamilies(svc)
+	if len(families) == 0 {
 		c.logger.Log("event", "clearAssignment", "reason", "noClusterIP")
+		clearStatusAnnotations(svc)
+		if wasAllocated {
+			c.logger.Log("event", "ipUnassigned", "msg", "removed loadbalancer from service, services will be reprocessed")
+			return k8s.SyncStateReprocessAll
+		}
 		return k8s.SyncStateSuccess
 	}
 
-	// If the service already has an address then we don't need to
-	// allocate one.
-	if len(svc.Status.LoadBalancer.Ingress) == 1 {
-		if existingIP := net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP); existingIP != nil {
+	// previous, if non-nil, is a snapshot of what each family had
+	// allocated before a mismatch-triggered release below. We compare
+	// it against the fresh allocation further down so that a reconverge
+	// onto a *different* still-valid address also reprocesses pending
+	// services, not just one that ends up with no address at all.
+	var previous map[Family]releasedAddress
+
+	// If the service already has an address for every family it
+	// wants, and that address still matches what the Service's
+	// annotations ask for, then we don't need to allocate anything,
+	// though we might still need to release a family it no longer
+	// wants (e.g. it switched from dual-stack back to single-stack,
+	// or dropped a family from spec.ClusterIPs).
+	if c.hasIngressFor(svc, families) {
+		if c.assignmentStillValid(name, svc, families) {
+			released := c.releaseUnwantedFamilies(name, families)
+			// families is already the stable order SetBalancer was
+			// called with; c.ips.Families(name) would also work here,
+			// but it ranges over a map and so can reorder the pool/family
+			// annotations below from one no-op reconcile to the next.
+			c.setStatusAnnotations(svc, name, families)
+			if released {
+				c.logger.Log("event", "ipUnassigned", "msg", "removed loadbalancer from service, services will be reprocessed")
+				return k8s.SyncStateReprocessAll
+			}
 			c.logger.Log("event", "ipAlreadySet")
 			return k8s.SyncStateSuccess
 		}
+
+		// The Service's annotations (address-pool, loadBalancerIP,
+		// sharing key) no longer match what it has allocated. Release
+		// it and fall through to allocate fresh, which lets a pending
+		// Service grab the slot we just freed if our new request can't
+		// be satisfied.
+		previous = map[Family]releasedAddress{}
+		for _, f := range c.ips.Families(name) {
+			previous[f] = releasedAddress{pool: c.ips.PoolFor(name, f), ip: c.ips.IPFor(name, f)}
+		}
+		c.ips.Unassign(name)
+		svc.Status.LoadBalancer.Ingress = nil
+		clearStatusAnnotations(svc)
 	}
 
-	pool, lbIP, err := c.allocateIP(name, svc)
+	if c.clustersetEnablementConflict(svc, families) {
+		c.logger.Log("event", "clustersetEnablementConflict", "service", name, "msg", "service was allocated by a clusterset-enabled pool in another cluster, but the pool isn't clusterset-enabled here")
+		c.client.Errorf(svc, "ConflictingClusterSetIPEnablement", "Service %q was allocated by a clusterset-enabled pool elsewhere, but its pool isn't clusterset-enabled in this cluster", name)
+		return k8s.SyncStateSuccess
+	}
+
+	pools, ips, err := c.allocateIPs(name, svc, families)
 	if err != nil {
 		c.logger.Log("op", "allocateIP", "error", err, "msg", "IP allocation failed")
 		c.client.Errorf(svc, "AllocationFailed", "Failed to allocate IP for %q: %s", name, err)
+		if wasAllocated && !c.isAllocated(name) {
+			c.logger.Log("event", "ipUnassigned", "msg", "removed loadbalancer from service, services will be reprocessed")
+			return k8s.SyncStateReprocessAll
+		}
 		return k8s.SyncStateSuccess
 	}
-	c.logger.Log("event", "ipAllocated", "ip", lbIP, "pool", pool, "service", name)
-	c.client.Infof(svc, "IPAllocated", "Assigned IP %q", lbIP)
 
-	// we have an IP selected somehow, so program the data plane
-	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: lbIP.String()}}
+	ingress := make([]v1.LoadBalancerIngress, 0, len(ips))
+	for _, ip := range ips {
+		c.logger.Log("event", "ipAllocated", "ip", ip, "service", name)
+		c.client.Infof(svc, "IPAllocated", "Assigned IP %q", ip)
+		ingress = append(ingress, v1.LoadBalancerIngress{IP: ip.String()})
+	}
+	svc.Status.LoadBalancer.Ingress = ingress
 
-	// annotate the service as "ours" and annotate the pool from which
-	// the address came
+	// annotate the service as "ours" and annotate the pool(s) from
+	// which the address(es) came
 	if svc.Annotations == nil {
 		svc.Annotations = map[string]string{}
 	}
-	svc.Annotations[brandAnnotation] = brand
-	svc.Annotations[poolAnnotation] = pool
+	svc.Annotations[purelbv1.BrandAnnotation] = purelbv1.Brand
+	svc.Annotations[purelbv1.PoolAnnotation] = pools[0]
+
+	releasedFamily := c.releaseUnwantedFamilies(name, families)
+
+	// If we released a family's old address above to satisfy an
+	// annotation change (e.g. address-pool or loadBalancerIP edited to
+	// a different, still-valid target), and the fresh allocation
+	// landed on a different (pool, ip) than what we released, that old
+	// address is now free for a pending service to grab.
+	reassignedDifferently := false
+	for i, family := range families {
+		if prev, ok := previous[family]; ok {
+			if prev.pool != pools[i] || !prev.ip.Equal(ips[i]) {
+				reassignedDifferently = true
+			}
+		}
+	}
+
+	c.setStatusAnnotations(svc, name, families)
 
 	if c.baseURL != nil {
 		// Connect to the EGW
@@ -103,38 +209,262 @@ func (c *controller) SetBalancer(name string, svc *v1.Service, _ *v1.Endpoints)
 			c.client.Errorf(svc, "AnnouncementFailed", "Failed to announce service for %s: %s", svc.Name, err)
 			return k8s.SyncStateError
 		}
-		svc.Annotations[groupAnnotation] = egwsvc.Links["group"]
-		svc.Annotations[serviceAnnotation] = egwsvc.Links["self"]
-		svc.Annotations[endpointAnnotation] = egwsvc.Links["create-endpoint"]
+		svc.Annotations[purelbv1.GroupAnnotation] = egwsvc.Links["group"]
+		svc.Annotations[purelbv1.ServiceAnnotation] = egwsvc.Links["self"]
+		svc.Annotations[purelbv1.EndpointAnnotation] = egwsvc.Links["create-endpoint"]
+		svc.Annotations[purelbv1.StatusEGWGroupAnnotation] = group.Name
 	}
 
+	if releasedFamily || reassignedDifferently {
+		c.logger.Log("event", "ipUnassigned", "msg", "removed loadbalancer from service, services will be reprocessed")
+		return k8s.SyncStateReprocessAll
+	}
 	return k8s.SyncStateSuccess
 }
 
-func (c *controller) allocateIP(key string, svc *v1.Service) (string, net.IP, error) {
-	// If the user asked for a specific IP, try that.
+// clustersetEnablementConflict reports whether svc was previously
+// allocated from a Clusterset-enabled pool (recorded by
+// ClustersetIPAllocatedByAnnotation) but can no longer reliably land
+// on a Clusterset-coordinated address in this cluster. That mismatch
+// means this cluster's configuration disagrees with whichever
+// cluster (this one or another) originally allocated the address, so
+// we leave the Service alone rather than risk handing it a second,
+// uncoordinated address.
+//
+// If svc names a desired pool, the check is just that pool's
+// enablement. Otherwise svc bruteforces across every pool of its
+// family, so it can only be trusted if all of them are
+// Clusterset-enabled; a mix would let it land in a non-coordinated
+// one just as easily.
+func (c *controller) clustersetEnablementConflict(svc *v1.Service, families []Family) bool {
+	if svc.Annotations[purelbv1.ClustersetIPAllocatedByAnnotation] == "" {
+		return false
+	}
+	if desiredPool := svc.Annotations[purelbv1.DesiredPoolAnnotation]; desiredPool != "" {
+		return !c.ips.PoolClustersetEnabled(desiredPool)
+	}
+	for _, family := range families {
+		if !c.ips.AllPoolsClustersetEnabled(family) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIngressFor reports whether svc.Status.LoadBalancer.Ingress
+// already contains exactly one valid address per family in
+// families.
+func (c *controller) hasIngressFor(svc *v1.Service, families []Family) bool {
+	ingress := svc.Status.LoadBalancer.Ingress
+	if len(ingress) != len(families) {
+		return false
+	}
+
+	want := map[Family]bool{}
+	for _, f := range families {
+		want[f] = true
+	}
+	for _, in := range ingress {
+		ip := net.ParseIP(in.IP)
+		if ip == nil || !want[FamilyOf(ip)] {
+			return false
+		}
+		delete(want, FamilyOf(ip))
+	}
+	return true
+}
+
+// assignmentStillValid reports whether key's current allocation for
+// every family in families still satisfies svc's annotations. A
+// mismatch here means the user edited the Service (changed its
+// desired pool, address name, loadBalancerIP or sharing key) since
+// we last allocated.
+func (c *controller) assignmentStillValid(key string, svc *v1.Service, families []Family) bool {
+	desiredPool := svc.Annotations[purelbv1.DesiredPoolAnnotation]
+	addrName := svc.Annotations[purelbv1.AddressNameAnnotation]
+	requestedIP := net.ParseIP(svc.Spec.LoadBalancerIP)
+
+	for _, family := range families {
+		pool := c.ips.PoolFor(key, family)
+		if pool == "" {
+			return false
+		}
+		if c.ips.allocated[key][family].sharingKey != SharingKey(svc) {
+			return false
+		}
+		if desiredPool != "" && desiredPool != pool {
+			return false
+		}
+		if addrName != "" {
+			if reservedIP, reservedFamily, ok := c.ips.ReservedAddress(addrName); ok && reservedFamily == family && !c.ips.IPFor(key, family).Equal(reservedIP) {
+				return false
+			}
+		}
+		if requestedIP != nil && FamilyOf(requestedIP) == family && !requestedIP.Equal(c.ips.IPFor(key, family)) {
+			return false
+		}
+	}
+	return true
+}
+
+// releaseUnwantedFamilies frees any address that key has allocated
+// for a family that's no longer in families, e.g. because the
+// Service was edited to drop a family from spec.ClusterIPs. It
+// returns true if it released anything.
+func (c *controller) releaseUnwantedFamilies(key string, families []Family) bool {
+	want := map[Family]bool{}
+	for _, f := range families {
+		want[f] = true
+	}
+	released := false
+	for _, f := range c.ips.Families(key) {
+		if !want[f] {
+			c.ips.UnassignFamily(key, f)
+			released = true
+		}
+	}
+	return released
+}
+
+// setStatusAnnotations records, in annotations under
+// purelbv1.StatusAnnotationPrefix, what PureLB actually did for
+// key's Service: the pool(s) its address(es) came from, their
+// family/families, a hash of its sharing key (if any), and the node
+// currently announcing it (if known). It overwrites any stale
+// entries left over from a previous allocation.
+func (c *controller) setStatusAnnotations(svc *v1.Service, key string, families []Family) {
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+
+	pools := make([]string, 0, len(families))
+	names := make([]string, 0, len(families))
+	for _, family := range families {
+		pool := c.ips.PoolFor(key, family)
+		// The IPv6 half of a dual-stack group is tracked under
+		// poolName(group, FamilyV6); report the ServiceGroup's own name.
+		if group := strings.TrimSuffix(pool, poolName("", FamilyV6)); family == FamilyV6 && group != pool {
+			if _, paired := c.ips.pools[group]; paired {
+				pool = group
+			}
+		}
+		pools = append(pools, pool)
+		names = append(names, family.String())
+	}
+	svc.Annotations[purelbv1.StatusPoolAnnotation] = strings.Join(pools, ",")
+	svc.Annotations[purelbv1.StatusFamilyAnnotation] = strings.Join(names, ",")
+
+	if sharingKey := SharingKey(svc); sharingKey != "" {
+		svc.Annotations[purelbv1.StatusSharingKeyHashAnnotation] = sharingKeyHash(sharingKey)
+	} else {
+		delete(svc.Annotations, purelbv1.StatusSharingKeyHashAnnotation)
+	}
+
+	if node := c.announcing[key]; node != "" {
+		svc.Annotations[purelbv1.StatusNodeAnnotation] = node
+	} else {
+		delete(svc.Annotations, purelbv1.StatusNodeAnnotation)
+	}
+
+	if allocatedBy := c.ips.ClustersetAllocatedBy(key); allocatedBy != "" {
+		svc.Annotations[purelbv1.ClustersetIPAllocatedByAnnotation] = allocatedBy
+	} else {
+		delete(svc.Annotations, purelbv1.ClustersetIPAllocatedByAnnotation)
+	}
+}
+
+// sharingKeyHash returns a short, non-reversible fingerprint of key,
+// suitable for an annotation that lets operators spot Services that
+// share an address without exposing the key itself.
+func sharingKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// clearStatusAnnotations removes any purelbv1.Status* annotations
+// from svc, e.g. because it no longer has an allocated address.
+func clearStatusAnnotations(svc *v1.Service) {
+	delete(svc.Annotations, purelbv1.StatusPoolAnnotation)
+	delete(svc.Annotations, purelbv1.StatusFamilyAnnotation)
+	delete(svc.Annotations, purelbv1.StatusSharingKeyHashAnnotation)
+	delete(svc.Annotations, purelbv1.StatusNodeAnnotation)
+	delete(svc.Annotations, purelbv1.StatusEGWGroupAnnotation)
+	delete(svc.Annotations, purelbv1.ClustersetIPAllocatedByAnnotation)
+}
+
+// allocateIPs allocates an address for each of families, rolling
+// back any addresses it allocated in this call if a later family
+// fails, so a partial allocation never sticks around.
+func (c *controller) allocateIPs(key string, svc *v1.Service, families []Family) ([]string, []net.IP, error) {
+	pools := make([]string, 0, len(families))
+	ips := make([]net.IP, 0, len(families))
+
+	for i, family := range families {
+		pool, ip, err := c.allocateIP(key, svc, family)
+		if err != nil {
+			for _, allocated := range families[:i] {
+				c.ips.UnassignFamily(key, allocated)
+			}
+			return nil, nil, err
+		}
+		pools = append(pools, pool)
+		ips = append(ips, ip)
+	}
+
+	return pools, ips, nil
+}
+
+func (c *controller) allocateIP(key string, svc *v1.Service, family Family) (string, net.IP, error) {
+	// If the user asked for a specific IP and it belongs to this
+	// family, try that.
 	if svc.Spec.LoadBalancerIP != "" {
 		ip := net.ParseIP(svc.Spec.LoadBalancerIP)
 		if ip == nil {
 			return "", nil, fmt.Errorf("invalid spec.loadBalancerIP %q", svc.Spec.LoadBalancerIP)
 		}
-		pool, err := c.ips.Assign(key, ip, Ports(svc), SharingKey(svc))
-		if err != nil {
-			return "", nil, err
+		if FamilyOf(ip) == family {
+			pool, err := c.ips.Assign(key, ip, Ports(svc), SharingKey(svc))
+			if err != nil {
+				return "", nil, err
+			}
+			return pool, ip, nil
+		}
+		// A single-stack Service whose requested address doesn't match
+		// its own family can never be satisfied.
+		if len(desiredFamilies(svc)) == 1 {
+			return "", nil, fmt.Errorf("spec.loadBalancerIP %q is %s, but service wants %s", ip, FamilyOf(ip), family)
+		}
+		// Dual-stack with a single-family loadBalancerIP: fall through
+		// and allocate this family normally.
+	}
+
+	// Did the user ask for a specific, pre-reserved Address by name?
+	if addrName := svc.Annotations[purelbv1.AddressNameAnnotation]; addrName != "" {
+		_, reservedFamily, ok := c.ips.ReservedAddress(addrName)
+		if !ok {
+			return "", nil, fmt.Errorf("no such address %q", addrName)
+		}
+		if reservedFamily == family {
+			return c.ips.AssignNamed(key, addrName, Ports(svc), SharingKey(svc))
+		}
+		if len(desiredFamilies(svc)) == 1 {
+			return "", nil, fmt.Errorf("address %q is %s, but service wants %s", addrName, reservedFamily, family)
 		}
-		return pool, ip, nil
+		// Dual-stack with a single-family reservation: fall through and
+		// allocate this family normally.
 	}
 
 	// Otherwise, did the user ask for a specific pool?
-	desiredPool := svc.Annotations[desiredPoolAnnotation]
+	desiredPool := svc.Annotations[purelbv1.DesiredPoolAnnotation]
 	if desiredPool != "" {
-		ip, err := c.ips.AllocateFromPool(key, desiredPool, Ports(svc), SharingKey(svc))
+		ip, err := c.ips.AllocateFromPool(key, desiredPool, family, Ports(svc), SharingKey(svc))
 		if err != nil {
 			return "", nil, err
 		}
 		return desiredPool, ip, nil
 	}
 
-	// Okay, in that case just bruteforce across all pools.
-	return c.ips.Allocate(key, Ports(svc), SharingKey(svc))
+	// Okay, in that case just bruteforce across all pools of the
+	// right family.
+	return c.ips.Allocate(key, family, Ports(svc), SharingKey(svc))
 }
@@ -0,0 +1,49 @@
+// Copyright 2020 Acnodal Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Address is a cluster-scoped reservation of one specific IP out of
+// an existing ServiceGroup's pool. Operators create an Address to
+// hand out a well-known VIP (one with a DNS record or firewall rule
+// already pointed at it) without embedding the literal address in a
+// Service manifest: the Service just sets the
+// purelb.io/address-name annotation to the Address's name.
+//
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type Address struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec AddressSpec `json:"spec,omitempty"`
+}
+
+// AddressSpec describes one reserved address.
+type AddressSpec struct {
+	// Pool is the name of the ServiceGroup that Address is carved
+	// out of. The address must fall within that group's pool.
+	Pool string `json:"pool"`
+
+	// Address is the reserved IP, e.g. "192.0.2.10".
+	Address string `json:"address"`
+
+	// SharingKey optionally lets several Services bind to this
+	// Address at once, the same way ServiceGroupLocalSpec addresses
+	// can be shared.
+	SharingKey string `json:"sharingKey,omitempty"`
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Acnodal Inc.
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1 holds the types that PureLB reads out of its
+// configuration, either from CRDs or (in simpler deployments) from a
+// ConfigMap that's parsed into the same shapes.
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// GroupName is the API group that PureLB's CRDs live under.
+	GroupName = "purelb.io"
+
+	// Brand is the value that PureLB writes into BrandAnnotation.
+	Brand = "PureLB"
+
+	// BrandAnnotation marks a Service as one that PureLB has
+	// allocated an address for.
+	BrandAnnotation = "purelb.io/allocated-by"
+
+	// PoolAnnotation records the name of the ServiceGroup that an
+	// allocated address came from.
+	PoolAnnotation = "purelb.io/allocated-from"
+
+	// SharingAnnotation lets two Services share one address, as long
+	// as they both set the same sharing key.
+	SharingAnnotation = "purelb.io/allow-shared-ip"
+
+	// DesiredPoolAnnotation lets the user request that their
+	// Service's address come from a specific pool.
+	DesiredPoolAnnotation = "purelb.io/address-pool"
+
+	// GroupAnnotation records the EGW group URL backing a Service.
+	GroupAnnotation = "acnodal.io/groupURL"
+
+	// ServiceAnnotation records the EGW service URL backing a
+	// Service.
+	ServiceAnnotation = "acnodal.io/serviceURL"
+
+	// EndpointAnnotation records the EGW endpoint-creation URL for a
+	// Service.
+	EndpointAnnotation = "acnodal.io/endpointcreateURL"
+
+	// AddressNameAnnotation lets the user request that their
+	// Service's address be a specific, pre-reserved Address.
+	AddressNameAnnotation = "purelb.io/address-name"
+
+	// StatusAnnotationPrefix marks annotations that PureLB writes to
+	// record what it did for a Service, as opposed to annotations
+	// like DesiredPoolAnnotation that the user sets to configure it.
+	StatusAnnotationPrefix = "purelb.io/status-"
+
+	// StatusPoolAnnotation records the name(s) of the ServiceGroup
+	// pool(s) that a Service's address(es) came from, one per family
+	// in ClusterIPs order, comma-separated for dual-stack Services.
+	StatusPoolAnnotation = StatusAnnotationPrefix + "pool"
+
+	// StatusFamilyAnnotation records the address famil(ies) PureLB
+	// allocated for a Service, in the same order as StatusPoolAnnotation.
+	StatusFamilyAnnotation = StatusAnnotationPrefix + "family"
+
+	// StatusSharingKeyHashAnnotation records a hash of the Service's
+	// sharing key, if it set one, so operators can see at a glance
+	// whether two Services are meant to share an address without
+	// exposing the key itself.
+	StatusSharingKeyHashAnnotation = StatusAnnotationPrefix + "sharing-key-hash"
+
+	// StatusNodeAnnotation records the node that's currently
+	// announcing a Service's address.
+	StatusNodeAnnotation = StatusAnnotationPrefix + "node"
+
+	// StatusEGWGroupAnnotation records the resolved name of the EGW
+	// group backing a Service, alongside the raw URLs in
+	// GroupAnnotation/ServiceAnnotation/EndpointAnnotation.
+	StatusEGWGroupAnnotation = StatusAnnotationPrefix + "egw-group"
+
+	// ClustersetIPAllocatedByAnnotation records the ID of the cluster
+	// that first allocated a Service's address from a Clusterset-
+	// enabled pool. Every cluster exporting the Service assigns the
+	// same address, and the reservation persists until the last of
+	// them unexports it, even if the allocating cluster leaves first.
+	ClustersetIPAllocatedByAnnotation = "purelb.io/clusterset-ip-allocated-by"
+)
+
+// Config is PureLB's parsed configuration: the set of address pools
+// that are available to allocate from, plus any named reservations
+// carved out of them.
+type Config struct {
+	Groups    []*ServiceGroup
+	Addresses []*Address
+}
+
+// ServiceGroup is a pool of addresses that PureLB can allocate
+// Service ingress addresses from.
+//
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+type ServiceGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ServiceGroupSpec `json:"spec,omitempty"`
+}
+
+// ServiceGroupSpec configures one address pool. Exactly one of
+// Local or EGW should be set.
+type ServiceGroupSpec struct {
+	Local *ServiceGroupLocalSpec `json:"local,omitempty"`
+	EGW   *ServiceGroupEGWSpec   `json:"egw,omitempty"`
+
+	// Clusterset, if set, coordinates allocation from this pool
+	// across multiple clusters so that a Service exported from each
+	// of them receives the same address. Only meaningful alongside
+	// Local; EGW pools are already managed by a single shared
+	// gateway.
+	Clusterset *ServiceGroupClustersetSpec `json:"clusterset,omitempty"`
+}
+
+// ServiceGroupLocalSpec is a pool of addresses that PureLB announces
+// itself, e.g. via ARP/NDP or BGP.
+type ServiceGroupLocalSpec struct {
+	// Pool is the CIDR that addresses are allocated from. Its
+	// family (IPv4 or IPv6) is inferred from the CIDR itself.
+	Pool string `json:"pool,omitempty"`
+
+	// Pool6 optionally pairs an IPv6 CIDR with Pool so the group can
+	// hand out one address of each family to dual-stack Services. If
+	// unset, the group only ever hands out addresses of Pool's
+	// family.
+	Pool6 string `json:"pool6,omitempty"`
+
+	// Aggregation is the CIDR prefix length that addresses are
+	// advertised with, e.g. "/32" to advertise single addresses.
+	Aggregation string `json:"aggregation,omitempty"`
+}
+
+// ServiceGroupEGWSpec configures a pool of addresses managed by an
+// Acnodal Enterprise Gateway.
+type ServiceGroupEGWSpec struct {
+	URL string `json:"url,omitempty"`
+}
+
+// ServiceGroupClustersetSpec enables coordinated, cross-cluster
+// allocation for a ServiceGroup's pool. The coordination broker and
+// this cluster's ID are configured once for the whole Allocator
+// (see allocator.Allocator.SetClusterset), not per pool.
+type ServiceGroupClustersetSpec struct{}